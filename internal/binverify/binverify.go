@@ -0,0 +1,191 @@
+// Package binverify checks that a downloaded binary actually matches the
+// os/cpu it was packaged under, and runs it (natively or through a
+// registered qemu-user interpreter) to capture real --version output where
+// possible.
+package binverify
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Result is what was learned about one binary.
+type Result struct {
+	// DetectedOS/DetectedArch come from the binary's own container header,
+	// independent of what package.json claims.
+	DetectedOS   string
+	DetectedArch string
+	// RunVia is "native", the qemu-user interpreter path used, or empty if
+	// the binary couldn't be executed at all in this environment.
+	RunVia      string
+	VersionInfo string
+}
+
+// Verify parses path's ELF/PE/Mach-O header, confirms it matches
+// declaredOS/declaredArch, and — natively or via qemu-user when running on
+// linux with binfmt_misc configured — runs `path --version`.
+func Verify(path, declaredOS, declaredArch string) (Result, error) {
+	var r Result
+
+	detectedOS, detectedArch, err := detect(path)
+	if err != nil {
+		return r, fmt.Errorf("detect binary format: %w", err)
+	}
+	r.DetectedOS, r.DetectedArch = detectedOS, detectedArch
+	if detectedOS != declaredOS || detectedArch != declaredArch {
+		return r, fmt.Errorf("binary is %s/%s, package.json declares %s/%s", detectedOS, detectedArch, declaredOS, declaredArch)
+	}
+
+	if goOS, goArch := goName(declaredOS), goArchName(declaredArch); goOS == runtime.GOOS && goArch == runtime.GOARCH {
+		if out, err := exec.Command(path, "--version").Output(); err == nil {
+			r.RunVia = "native"
+			r.VersionInfo = strings.TrimSpace(string(out))
+		}
+		return r, nil
+	}
+
+	if runtime.GOOS != "linux" {
+		// no binfmt_misc outside linux, so a foreign binary just can't run here
+		return r, nil
+	}
+	interpreter, err := qemuInterpreter(detectedArch)
+	if err != nil || interpreter == "" {
+		return r, nil
+	}
+	if out, err := exec.Command(interpreter, path, "--version").Output(); err == nil {
+		r.RunVia = interpreter
+		r.VersionInfo = strings.TrimSpace(string(out))
+	}
+	return r, nil
+}
+
+// detect returns our os/cpu naming (matching publish.go's OS/CPU.String())
+// for the actual container format of the file at path.
+func detect(path string) (os, arch string, err error) {
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		a, err := elfArch(f.Machine)
+		return "linux", a, err
+	}
+	if f, err := macho.Open(path); err == nil {
+		defer f.Close()
+		a, err := machoArch(f.Cpu)
+		return "darwin", a, err
+	}
+	if f, err := pe.Open(path); err == nil {
+		defer f.Close()
+		a, err := peArch(f.Machine)
+		return "win32", a, err
+	}
+	return "", "", fmt.Errorf("%s is not a recognised ELF, Mach-O or PE binary", path)
+}
+
+func elfArch(m elf.Machine) (string, error) {
+	switch m {
+	case elf.EM_X86_64:
+		return "x64", nil
+	case elf.EM_AARCH64:
+		return "arm64", nil
+	case elf.EM_ARM:
+		return "arm", nil
+	case elf.EM_PPC64:
+		return "ppc64", nil
+	case elf.EM_RISCV:
+		return "riscv64", nil
+	case elf.EM_S390:
+		return "s390x", nil
+	default:
+		return "", fmt.Errorf("unsupported ELF machine %s", m)
+	}
+}
+
+func machoArch(c macho.Cpu) (string, error) {
+	switch c {
+	case macho.CpuAmd64:
+		return "x64", nil
+	case macho.CpuArm64:
+		return "arm64", nil
+	default:
+		return "", fmt.Errorf("unsupported Mach-O cpu %s", c)
+	}
+}
+
+func peArch(m uint16) (string, error) {
+	switch m {
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return "x64", nil
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return "arm64", nil
+	default:
+		return "", fmt.Errorf("unsupported PE machine 0x%x", m)
+	}
+}
+
+// goNames maps our (npm-style) os naming to runtime.GOOS.
+var goNames = map[string]string{
+	"darwin": "darwin",
+	"linux":  "linux",
+	"win32":  "windows",
+}
+
+// goName translates declaredOS (as recorded in package.json) to the
+// runtime.GOOS spelling, or "" if there's no such platform.
+func goName(declaredOS string) string {
+	return goNames[declaredOS]
+}
+
+// goArchNames maps our (npm-style) cpu naming to runtime.GOARCH.
+var goArchNames = map[string]string{
+	"x64":     "amd64",
+	"arm64":   "arm64",
+	"arm":     "arm",
+	"ppc64":   "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// goArchName translates declaredArch (as recorded in package.json) to the
+// runtime.GOARCH spelling, or "" if there's no such arch.
+func goArchName(declaredArch string) string {
+	return goArchNames[declaredArch]
+}
+
+// qemuArchNames maps our arch naming to the qemu-user binfmt_misc names
+// registered by qemu-user-static's update-binfmts hooks.
+var qemuArchNames = map[string]string{
+	"x64":     "qemu-x86_64",
+	"arm64":   "qemu-aarch64",
+	"arm":     "qemu-arm",
+	"ppc64":   "qemu-ppc64le",
+	"riscv64": "qemu-riscv64",
+	"s390x":   "qemu-s390x",
+}
+
+// qemuInterpreter returns the path to the qemu-user interpreter registered
+// in /proc/sys/fs/binfmt_misc for arch, or "" if none is registered.
+func qemuInterpreter(arch string) (string, error) {
+	name, ok := qemuArchNames[arch]
+	if !ok {
+		return "", nil
+	}
+	entry, err := os.ReadFile(filepath.Join("/proc/sys/fs/binfmt_misc", name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, line := range strings.Split(string(entry), "\n") {
+		if rest, ok := strings.CutPrefix(line, "interpreter "); ok {
+			return strings.TrimSpace(rest), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,406 @@
+// Package ghrelease fetches GitHub release assets and extracts a named
+// binary out of whichever archive format the release happens to ship,
+// without the caller needing to know which one it picked.
+package ghrelease
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v50/github"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sync/errgroup"
+)
+
+// Asset is a release asset whose name matched the assetRegexp passed to
+// Fetch, along with the regexp's submatches (e.g. captured os/arch groups).
+type Asset struct {
+	Name        string
+	DownloadURL string
+	Release     *github.RepositoryRelease
+	Match       []string
+	// NodeID and Size key the local download cache, so a byte-identical
+	// asset is never fetched twice across runs.
+	NodeID string
+	Size   int64
+}
+
+// Fetch lists releases of owner/repo whose tag matches tagRegexp and returns
+// every asset of those releases whose name matches assetRegexp.
+func Fetch(ctx context.Context, client *github.Client, owner, repo string, tagRegexp, assetRegexp *regexp.Regexp) ([]Asset, error) {
+	var assets []Asset
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		releases, resp, err := client.Repositories.ListReleases(ctx, owner, repo, opt)
+		if err != nil {
+			return nil, fmt.Errorf("list releases: %w", err)
+		}
+		for _, release := range releases {
+			if !tagRegexp.MatchString(release.GetTagName()) {
+				continue
+			}
+			for _, a := range release.Assets {
+				match := assetRegexp.FindStringSubmatch(a.GetName())
+				if match == nil {
+					continue
+				}
+				assets = append(assets, Asset{
+					Name:        a.GetName(),
+					DownloadURL: a.GetBrowserDownloadURL(),
+					Release:     release,
+					Match:       match,
+					NodeID:      a.GetNodeID(),
+					Size:        int64(a.GetSize()),
+				})
+			}
+		}
+		if resp == nil || resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return assets, nil
+}
+
+// ExtractBinary downloads asset (through the package-wide default Fetcher,
+// so it shares its cache and retry behaviour) and extracts the file named
+// binaryName from its archive to destPath. See Fetcher.Extract for details.
+func ExtractBinary(asset Asset, binaryName, destPath string) (n int64, archiveSHA256 string, err error) {
+	return defaultFetcher().Extract(context.Background(), asset, binaryName, destPath)
+}
+
+// ExtractResult is one asset's outcome from Fetcher.ExtractAll.
+type ExtractResult struct {
+	Asset         Asset
+	Size          int64
+	ArchiveSHA256 string
+	Err           error
+}
+
+// Fetcher downloads release assets with a bounded worker pool, resuming
+// interrupted downloads via HTTP Range requests and caching completed
+// downloads on disk (keyed by node ID + size) so repeat runs skip intact
+// files entirely.
+type Fetcher struct {
+	Client      *http.Client
+	CacheDir    string
+	Concurrency int
+}
+
+var sharedFetcher *Fetcher
+
+func defaultFetcher() *Fetcher {
+	if sharedFetcher == nil {
+		sharedFetcher = NewFetcher()
+	}
+	return sharedFetcher
+}
+
+// NewFetcher builds a Fetcher with the package's default timeout, retry and
+// concurrency settings.
+func NewFetcher() *Fetcher {
+	cacheRoot := os.Getenv("XDG_CACHE_HOME")
+	if cacheRoot == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			cacheRoot = filepath.Join(home, ".cache")
+		} else {
+			cacheRoot = os.TempDir()
+		}
+	}
+	return &Fetcher{
+		Client:      &http.Client{Timeout: 5 * time.Minute},
+		CacheDir:    filepath.Join(cacheRoot, "buildctl-dockerfile"),
+		Concurrency: runtime.NumCPU(),
+	}
+}
+
+// ExtractAll downloads and extracts every asset concurrently, bounded to
+// f.Concurrency in flight at a time. binaryName and destPath are called once
+// per asset to get the in-archive file to extract and where it should land.
+// A failing asset does not abort the others; its error is carried in the
+// corresponding ExtractResult.
+func (f *Fetcher) ExtractAll(ctx context.Context, assets []Asset, binaryName func(Asset) string, destPath func(Asset) string) []ExtractResult {
+	results := make([]ExtractResult, len(assets))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(f.Concurrency)
+	for i, asset := range assets {
+		i, asset := i, asset
+		name, dest := binaryName(asset), destPath(asset)
+		g.Go(func() error {
+			n, sha, err := f.Extract(gctx, asset, name, dest)
+			results[i] = ExtractResult{Asset: asset, Size: n, ArchiveSHA256: sha, Err: err}
+			return nil // per-asset errors are reported via the result, not the group
+		})
+	}
+	g.Wait()
+	return results
+}
+
+// Extract downloads asset (via the cache, resuming a partial download if one
+// is present) and extracts the file named binaryName from its archive to
+// destPath. It returns the number of bytes written and the sha256 of the
+// archive as downloaded, so callers can cross-check it against a separately
+// obtained digest (e.g. release provenance) without a second download.
+func (f *Fetcher) Extract(ctx context.Context, asset Asset, binaryName, destPath string) (n int64, archiveSHA256 string, err error) {
+	cached, err := f.download(ctx, asset)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: %w", asset.Name, err)
+	}
+	archive, err := os.Open(cached)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: open cached download: %w", asset.Name, err)
+	}
+	defer archive.Close()
+
+	digest := sha256.New()
+	body := io.TeeReader(archive, digest)
+
+	switch {
+	case strings.HasSuffix(asset.Name, ".tar.gz"), strings.HasSuffix(asset.Name, ".tgz"):
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(body)
+		if err != nil {
+			return 0, "", fmt.Errorf("%s: gzip reader: %w", asset.Name, err)
+		}
+		defer gz.Close()
+		n, err = extractTar(tar.NewReader(gz), asset.Name, binaryName, destPath)
+	case strings.HasSuffix(asset.Name, ".tar.bz2"):
+		n, err = extractTar(tar.NewReader(bzip2.NewReader(body)), asset.Name, binaryName, destPath)
+	case strings.HasSuffix(asset.Name, ".tar.xz"):
+		var xr io.Reader
+		xr, err = xz.NewReader(body)
+		if err != nil {
+			return 0, "", fmt.Errorf("%s: xz reader: %w", asset.Name, err)
+		}
+		n, err = extractTar(tar.NewReader(xr), asset.Name, binaryName, destPath)
+	case strings.HasSuffix(asset.Name, ".zip"):
+		n, err = extractZip(body, asset.Name, binaryName, destPath)
+	default:
+		err = fmt.Errorf("%s: unsupported archive format", asset.Name)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	// drain whatever the format reader didn't consume (e.g. archive
+	// padding/trailers) so the digest covers the full download.
+	io.Copy(io.Discard, body)
+	return n, fmt.Sprintf("%x", digest.Sum(nil)), nil
+}
+
+// downloadError distinguishes a downloadOnce failure worth retrying (a
+// network blip or 5xx response) from one that a retry can't fix, like a
+// 404/403 — those should fail the download immediately rather than burn
+// through maxAttempts on something that will never succeed.
+type downloadError struct {
+	retryable bool
+	err       error
+}
+
+func (e *downloadError) Error() string { return e.err.Error() }
+func (e *downloadError) Unwrap() error { return e.err }
+
+// download returns the path to a complete, cached local copy of asset,
+// fetching it (with Range resumption and retry-on-5xx) if it isn't already
+// there.
+func (f *Fetcher) download(ctx context.Context, asset Asset) (string, error) {
+	if err := os.MkdirAll(f.CacheDir, 0755); err != nil {
+		return "", fmt.Errorf("cache dir: %w", err)
+	}
+	key := asset.NodeID
+	if key == "" {
+		key = asset.Name
+	}
+	final := filepath.Join(f.CacheDir, fmt.Sprintf("%s-%d", key, asset.Size))
+	if stat, err := os.Stat(final); err == nil && (asset.Size == 0 || stat.Size() == asset.Size) {
+		return final, nil
+	}
+
+	partial := final + ".part"
+	const maxAttempts = 5
+	backoff := time.Second
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		if err := f.downloadOnce(ctx, asset, partial); err != nil {
+			lastErr = err
+			var de *downloadError
+			if errors.As(err, &de) && !de.retryable {
+				break
+			}
+			continue
+		}
+
+		if asset.Size != 0 {
+			stat, err := os.Stat(partial)
+			if err != nil {
+				lastErr = fmt.Errorf("stat partial download: %w", err)
+				continue
+			}
+			if stat.Size() != asset.Size {
+				lastErr = fmt.Errorf("downloaded %d bytes, expected %d", stat.Size(), asset.Size)
+				continue
+			}
+		}
+
+		if err := os.Rename(partial, final); err != nil {
+			return "", fmt.Errorf("finalize download: %w", err)
+		}
+		return final, nil
+	}
+	return "", fmt.Errorf("download failed: %w", lastErr)
+}
+
+// downloadOnce appends to (or starts) partial via an HTTP Range request,
+// resuming whatever bytes are already on disk from a prior attempt.
+func (f *Fetcher) downloadOnce(ctx context.Context, asset Asset, partial string) error {
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open partial download: %w", err)
+	}
+	defer out.Close()
+
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seek partial download: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, asset.DownloadURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return &downloadError{retryable: true, err: fmt.Errorf("request: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// server ignored our Range request; start over
+		if err := out.Truncate(0); err != nil {
+			return fmt.Errorf("truncate partial download: %w", err)
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case http.StatusPartialContent:
+		// appending from offset, nothing to do
+	case http.StatusRequestedRangeNotSatisfiable:
+		// we already have the whole thing
+		return nil
+	default:
+		if resp.StatusCode >= 500 {
+			return &downloadError{retryable: true, err: fmt.Errorf("server error: %s", resp.Status)}
+		}
+		return &downloadError{retryable: false, err: fmt.Errorf("unexpected status: %s", resp.Status)}
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return &downloadError{retryable: true, err: fmt.Errorf("copy response body: %w", err)}
+	}
+	return nil
+}
+
+func extractTar(r *tar.Reader, assetName, binaryName, destPath string) (int64, error) {
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return 0, fmt.Errorf("%s: %s not found in archive", assetName, binaryName)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: tar next: %w", assetName, err)
+		}
+		if header.Name == "pax_global_header" {
+			continue
+		}
+		if err := rejectUnsafePath(header.Name); err != nil {
+			return 0, fmt.Errorf("%s: %w", assetName, err)
+		}
+		if path.Base(header.Name) != binaryName {
+			continue
+		}
+		return writeBinary(r, destPath)
+	}
+}
+
+func extractZip(r io.Reader, assetName, binaryName, destPath string) (int64, error) {
+	// zip needs io.ReaderAt + size, so the archive has to be buffered.
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("%s: read zip: %w", assetName, err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: zip reader: %w", assetName, err)
+	}
+	for _, f := range zr.File {
+		if err := rejectUnsafePath(f.Name); err != nil {
+			return 0, fmt.Errorf("%s: %w", assetName, err)
+		}
+		if path.Base(f.Name) != binaryName {
+			continue
+		}
+		in, err := f.Open()
+		if err != nil {
+			return 0, fmt.Errorf("%s: open %s: %w", assetName, f.Name, err)
+		}
+		defer in.Close()
+		return writeBinary(in, destPath)
+	}
+	return 0, fmt.Errorf("%s: %s not found in archive", assetName, binaryName)
+}
+
+func writeBinary(r io.Reader, destPath string) (int64, error) {
+	out, err := os.Create(destPath)
+	if err != nil {
+		return 0, fmt.Errorf("create %s: %w", destPath, err)
+	}
+	n, err := io.Copy(out, r)
+	out.Close()
+	if err != nil {
+		return 0, fmt.Errorf("extract to %s: %w", destPath, err)
+	}
+	if err := os.Chmod(destPath, 0755); err != nil {
+		return 0, fmt.Errorf("chmod %s: %w", destPath, err)
+	}
+	return n, nil
+}
+
+func rejectUnsafePath(name string) error {
+	if path.IsAbs(name) {
+		return fmt.Errorf("refusing absolute archive entry %q", name)
+	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("refusing archive entry with parent reference %q", name)
+	}
+	return nil
+}
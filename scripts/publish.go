@@ -1,9 +1,9 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,20 +16,57 @@ import (
 	"strings"
 
 	"github.com/google/go-github/v50/github"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	"github.com/sigstore/sigstore/pkg/fulcioroots"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/mod/semver"
+	"golang.org/x/oauth2"
+
+	"github.com/turbokube/buildctl-dockerfile/internal/ghrelease"
 )
 
 const (
 	owner = "moby"
 	repo  = "buildkit"
+
+	// fulcioIssuer is the OIDC issuer buildkit's release workflow signs with.
+	fulcioIssuer = "https://token.actions.githubusercontent.com"
+
+	// defaultChannels is used when BUILDCTL_CHANNELS isn't set.
+	defaultChannels = "latest-stable"
 )
 
 var (
-	publishVersion    = "0.22.0"
 	releaseBinaryName = regexp.MustCompile(`^buildkit-v(?P<version>\d+\.\d+\.\d+)\.(?P<os>[a-z0-9]+)-(?P<arch>[a-z0-9\-]+)\.tar\.gz$`)
+	provenanceName    = regexp.MustCompile(`\.intoto\.jsonl$`)
+	channelConstraint = regexp.MustCompile(`^~(\d+\.\d+)$`)
 )
 
+// ManifestEntry describes one packaged (version, platform) pair so CI can
+// drive `npm publish` across several resolved versions without a code change.
+type ManifestEntry struct {
+	Version    string `json:"version"`
+	Sha256     string `json:"sha256"`
+	AssetURL   string `json:"asset_url"`
+	NpmPackage string `json:"npm_package"`
+	NpmTag     string `json:"npm_tag"`
+}
+
+// inTotoStatement is the subset of an in-toto/SLSA provenance statement we
+// need to cross-check a downloaded asset's digest.
+type inTotoStatement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+}
+
+// dsseEnvelope is the DSSE wrapper GitHub attaches the provenance payload in.
+type dsseEnvelope struct {
+	Payload string `json:"payload"`
+}
+
 type OS int
 
 type CPU int
@@ -54,6 +91,16 @@ type BinPackage struct {
 	Bin         map[string]string `json:"bin"`
 	Os          []OS              `json:"os"`
 	Cpu         []CPU             `json:"cpu"`
+	// Integrity is a subresource-integrity style digest (e.g. "sha512-...")
+	// of the extracted binary, recorded so test.go can detect the shipped
+	// file changing after packaging. It does not by itself prove the binary
+	// came from the signed release archive — ArchiveSha256 carries that.
+	Integrity string `json:"integrity,omitempty"`
+	// ArchiveSha256 is the release archive's sha256 as verified against its
+	// SLSA provenance by verifyProvenance, recorded so test.go can confirm
+	// this package.json still names the same provenance-checked archive as
+	// manifest.json rather than trusting the two not to have drifted apart.
+	ArchiveSha256 string `json:"archiveSha256,omitempty"`
 }
 
 const (
@@ -154,9 +201,6 @@ func main() {
 	undo := zap.ReplaceGlobals(logger)
 	defer undo()
 
-	var publishTag *github.RepositoryTag
-	var publishRelease *github.RepositoryRelease
-
 	var err error
 
 	parent := ParentPackage{}
@@ -168,54 +212,97 @@ func main() {
 		zap.L().Fatal("unmarshal package.json", zap.Error(err))
 	}
 
-	client := github.NewClient(nil)
-	repository, _, err := client.Repositories.Get(ctx, owner, repo)
+	githubToken := os.Getenv("GITHUB_TOKEN")
+	var client *github.Client
+	if githubToken != "" {
+		tc := oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: githubToken}))
+		client = github.NewClient(tc)
+	} else {
+		zap.L().Warn("GITHUB_TOKEN not set, using anonymous GitHub API access (low rate limit)")
+		client = github.NewClient(nil)
+	}
+	fetcher := ghrelease.NewFetcher()
+
+	allReleases, err := listAllReleases(ctx, client)
+	if err != nil {
+		zap.L().Fatal("list releases", zap.Error(err))
+	}
+
+	channelSpec := os.Getenv("BUILDCTL_CHANNELS")
+	if channelSpec == "" {
+		channelSpec = defaultChannels
+	}
+	publishReleases, err := resolveChannels(strings.Split(channelSpec, ","), allReleases)
 	if err != nil {
-		zap.L().Fatal("repository access", zap.Error(err))
+		zap.L().Fatal("resolve channels", zap.String("channels", channelSpec), zap.Error(err))
 	}
 
-	tags, _, err := client.Repositories.ListTags(ctx, owner, repo, nil)
+	npm, err := filepath.Abs("../npm")
 	if err != nil {
-		zap.L().Fatal("tags access", zap.Error(err))
+		zap.L().Fatal("parent dir", zap.Error(err))
 	}
-	for _, tag := range tags {
-		if *tag.Name == fmt.Sprintf("v%s", publishVersion) {
-			publishTag = tag
+
+	var remainingWork []string
+	var manifest []ManifestEntry
+	for _, release := range publishReleases {
+		npmTag := "latest"
+		if release.GetPrerelease() {
+			npmTag = "next"
 		}
-		zap.L().Debug("tag", zap.String("name", *tag.Name), zap.String("sha", *tag.Commit.SHA))
+		entries, work := packageRelease(ctx, fetcher, client, parent, release, npm, npmTag)
+		manifest = append(manifest, entries...)
+		remainingWork = append(remainingWork, work...)
 	}
 
-	releases, _, err := client.Repositories.ListReleases(ctx, owner, repo, nil)
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
-		zap.L().Fatal("releases access", zap.Error(err))
+		zap.L().Fatal("marshal manifest", zap.Error(err))
 	}
-	for _, release := range releases {
-		if *release.TagName == *publishTag.Name {
-			publishRelease = release
-		}
-		zap.L().Debug("release", zap.String("tag", *release.TagName))
+	if err := ioutil.WriteFile(path.Join(npm, "manifest.json"), manifestJSON, 0644); err != nil {
+		zap.L().Fatal("write manifest", zap.Error(err))
 	}
 
-	if publishRelease == nil {
-		zap.L().Warn("not released yet", zap.String("tag", *publishTag.Name))
-		publishRelease, err = releaseFromTag(ctx, client, repository, publishTag)
-		if err != nil {
-			zap.L().Fatal("release from tag", zap.Error(err))
-		}
+	if err := writeUmbrellaPackage(npm, parent, manifest); err != nil {
+		zap.L().Fatal("write umbrella package", zap.Error(err))
 	}
+	remainingWork = append(remainingWork, "(cd npm/buildctl; npm publish --access public)")
 
-	var remainingWork = make([]string, 0)
-	npm, err := filepath.Abs("../npm")
+	fmt.Println(strings.Join(remainingWork, "\n"))
+}
+
+// platformPackage is the per-asset packaging plan built before any bytes are
+// downloaded, so the download/extract step can run fully in parallel.
+type platformPackage struct {
+	asset        ghrelease.Asset
+	pkg          BinPackage
+	dir          string
+	bin          string
+	targetBinary string
+}
+
+// packageRelease verifies release's provenance, extracts and packages every
+// platform asset it ships, and returns the npm publish commands plus
+// manifest entries for the versions it produced.
+func packageRelease(ctx context.Context, fetcher *ghrelease.Fetcher, client *github.Client, parent ParentPackage, release *github.RepositoryRelease, npm, npmTag string) ([]ManifestEntry, []string) {
+	var manifest []ManifestEntry
+	var remainingWork []string
+
+	provenanceDigests, err := verifyProvenance(ctx, client, release)
 	if err != nil {
-		zap.L().Fatal("parent dir", zap.Error(err))
+		zap.L().Error("verify release provenance, skipping release", zap.String("tag", release.GetTagName()), zap.Error(err))
+		return manifest, remainingWork
 	}
-	for _, asset := range publishRelease.Assets {
-		match := releaseBinaryName.FindStringSubmatch(*asset.Name)
-		zap.L().Debug("asset", zap.String("name", *asset.Name), zap.Strings("match", match))
-		if len(match) == 0 {
-			zap.L().Debug("ignore", zap.String("name", *asset.Name))
-			continue
-		}
+
+	tagRegexp := regexp.MustCompile(fmt.Sprintf("^%s$", regexp.QuoteMeta(release.GetTagName())))
+	assets, err := ghrelease.Fetch(ctx, client, owner, repo, tagRegexp, releaseBinaryName)
+	if err != nil {
+		zap.L().Error("fetch release assets, skipping release", zap.String("tag", release.GetTagName()), zap.Error(err))
+		return manifest, remainingWork
+	}
+
+	plans := make([]platformPackage, 0, len(assets))
+	for _, asset := range assets {
+		match := asset.Match
 		version := match[1]
 		o := NewOs(match[2])
 		cpu := NewCPU(match[3])
@@ -239,80 +326,485 @@ func main() {
 		dir := path.Join(npm, p.Name)
 		bindir := path.Join(dir, "bin")
 		if err := os.MkdirAll(bindir, 0755); err != nil {
-			zap.L().Fatal("package dir", zap.Error(err))
+			zap.L().Error("package dir", zap.String("asset", asset.Name), zap.Error(err))
+			continue
 		}
 		oldbins, err := os.ReadDir(bindir)
 		if err != nil {
-			zap.L().Fatal("list existing", zap.String("dir", bindir), zap.Error(err))
+			zap.L().Error("list existing", zap.String("dir", bindir), zap.Error(err))
+			continue
 		}
 		for _, old := range oldbins {
 			if err := os.Remove(path.Join(bindir, old.Name())); err != nil {
-				zap.L().Fatal("remove existing", zap.String("name", old.Name()), zap.Error(err))
+				zap.L().Error("remove existing", zap.String("name", old.Name()), zap.Error(err))
+				continue
 			}
 		}
+
+		targetBinary := "buildctl"
+		if o.String() == "win32" {
+			targetBinary = "buildctl.exe"
+		}
+		plans = append(plans, platformPackage{
+			asset:        asset,
+			pkg:          p,
+			dir:          dir,
+			bin:          path.Join(dir, p.Bin["buildctl"]),
+			targetBinary: targetBinary,
+		})
+	}
+
+	planByAsset := make(map[string]platformPackage, len(plans))
+	assetsToFetch := make([]ghrelease.Asset, 0, len(plans))
+	for _, plan := range plans {
+		planByAsset[plan.asset.Name] = plan
+		assetsToFetch = append(assetsToFetch, plan.asset)
+	}
+	results := fetcher.ExtractAll(ctx, assetsToFetch,
+		func(a ghrelease.Asset) string { return planByAsset[a.Name].targetBinary },
+		func(a ghrelease.Asset) string { return planByAsset[a.Name].bin },
+	)
+
+	for _, result := range results {
+		plan := planByAsset[result.Asset.Name]
+		p := plan.pkg
+		if result.Err != nil {
+			zap.L().Error("extract binary, skipping platform", zap.String("asset", result.Asset.Name), zap.Error(result.Err))
+			continue
+		}
+
+		expected, known := provenanceDigests[result.Asset.Name]
+		if !known {
+			// SLSA subjects are sometimes recorded path-prefixed rather than
+			// as a bare filename; fall back to matching on basename before
+			// deciding there's truly no subject for this asset.
+			for name, d := range provenanceDigests {
+				if path.Base(name) == result.Asset.Name {
+					expected, known = d, true
+					break
+				}
+			}
+		}
+		switch {
+		case known && result.ArchiveSHA256 != expected:
+			zap.L().Error("archive digest does not match provenance, skipping platform",
+				zap.String("asset", result.Asset.Name), zap.String("expected", expected), zap.String("actual", result.ArchiveSHA256))
+			continue
+		case !known && len(provenanceDigests) > 0:
+			// the release's provenance was verified but names no subject for
+			// this asset: fail closed rather than package an unverified file.
+			zap.L().Error("no provenance subject matches asset, skipping platform", zap.String("asset", result.Asset.Name))
+			continue
+		case !known:
+			zap.L().Warn("release has no provenance digests, packaging without chain-of-custody check", zap.String("asset", result.Asset.Name))
+		}
+
+		p.Integrity, err = integrity(plan.bin)
+		if err != nil {
+			zap.L().Error("compute integrity", zap.String("asset", result.Asset.Name), zap.Error(err))
+			continue
+		}
+		p.ArchiveSha256 = result.ArchiveSHA256
+
 		j, err := json.MarshalIndent(p, "", "  ")
 		if err != nil {
-			zap.L().Fatal("marshal package.json", zap.Error(err))
+			zap.L().Error("marshal package.json", zap.String("asset", result.Asset.Name), zap.Error(err))
+			continue
 		}
-		if err := ioutil.WriteFile(path.Join(dir, "package.json"), j, 0644); err != nil {
-			zap.L().Fatal("write package.json", zap.Error(err))
+		if err := ioutil.WriteFile(path.Join(plan.dir, "package.json"), j, 0644); err != nil {
+			zap.L().Error("write package.json", zap.String("asset", result.Asset.Name), zap.Error(err))
+			continue
 		}
-		bin := path.Join(dir, p.Bin["buildctl"])
-		url := asset.GetBrowserDownloadURL()
-		download, err := http.Get(url)
+		zap.L().Info("generated package", zap.String("at", plan.dir), zap.Int64("binSize", result.Size), zap.String("integrity", p.Integrity))
+		manifest = append(manifest, ManifestEntry{
+			Version:    p.Version,
+			Sha256:     result.ArchiveSHA256,
+			AssetURL:   result.Asset.DownloadURL,
+			NpmPackage: p.Name,
+			NpmTag:     npmTag,
+		})
+		remainingWork = append(remainingWork, fmt.Sprintf("(cd npm/%s; npm publish --access public --tag %s)", p.Name, npmTag))
+	}
+	return manifest, remainingWork
+}
+
+// listAllReleases paginates through every release of owner/repo.
+func listAllReleases(ctx context.Context, client *github.Client) ([]*github.RepositoryRelease, error) {
+	var all []*github.RepositoryRelease
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		releases, resp, err := client.Repositories.ListReleases(ctx, owner, repo, opt)
 		if err != nil {
-			zap.L().Fatal("download", zap.String("url", url), zap.Error(err))
+			return nil, fmt.Errorf("list releases: %w", err)
+		}
+		all = append(all, releases...)
+		if resp == nil || resp.NextPage == 0 {
+			break
 		}
-		defer download.Body.Close()
+		opt.Page = resp.NextPage
+	}
+	return all, nil
+}
 
-		// Extract buildctl from tar.gz
-		gzipReader, err := gzip.NewReader(download.Body)
+// resolveChannels resolves each channel spec against all and returns the
+// matching releases, deduplicated by tag and in the order first resolved.
+func resolveChannels(specs []string, all []*github.RepositoryRelease) ([]*github.RepositoryRelease, error) {
+	seen := make(map[string]bool)
+	var resolved []*github.RepositoryRelease
+	for _, spec := range specs {
+		release, err := resolveChannel(strings.TrimSpace(spec), all)
 		if err != nil {
-			zap.L().Fatal("gzip reader", zap.Error(err))
+			return nil, fmt.Errorf("channel %q: %w", spec, err)
 		}
-		defer gzipReader.Close()
-
-		tarReader := tar.NewReader(gzipReader)
-		var n int64
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				zap.L().Fatal("tar next", zap.Error(err))
-			}
+		if tag := release.GetTagName(); !seen[tag] {
+			seen[tag] = true
+			resolved = append(resolved, release)
+		}
+	}
+	return resolved, nil
+}
 
-			// Look for buildctl binary (handles both Unix and Windows naming)
-			targetBinary := "buildctl"
-			if o.String() == "win32" {
-				targetBinary = "buildctl.exe"
-			}
-			if strings.HasSuffix(header.Name, "/"+targetBinary) || header.Name == targetBinary {
-				out, err := os.Create(bin)
-				if err != nil {
-					zap.L().Fatal("create binary", zap.String("path", bin), zap.Error(err))
-				}
-				n, err = io.Copy(out, tarReader)
-				out.Close()
-				if err != nil {
-					zap.L().Fatal("extract binary", zap.Error(err))
-				}
-				if err := os.Chmod(bin, 0755); err != nil {
-					zap.L().Fatal("bin chmod", zap.Error(err))
-				}
-				break
+// resolveChannel picks the release matching a channel spec:
+//   - "latest": the newest release, prerelease or not
+//   - "latest-stable": the newest non-prerelease release
+//   - "~0.22": the newest stable release on the 0.22.x line
+//   - "v0.22.0": that exact tag
+func resolveChannel(spec string, all []*github.RepositoryRelease) (*github.RepositoryRelease, error) {
+	switch {
+	case spec == "latest":
+		return newestRelease(all, func(r *github.RepositoryRelease) bool { return true })
+	case spec == "latest-stable":
+		return newestRelease(all, func(r *github.RepositoryRelease) bool { return !r.GetPrerelease() })
+	case channelConstraint.MatchString(spec):
+		minor := channelConstraint.FindStringSubmatch(spec)[1]
+		prefix := fmt.Sprintf("v%s.", minor)
+		return newestRelease(all, func(r *github.RepositoryRelease) bool {
+			return !r.GetPrerelease() && strings.HasPrefix(r.GetTagName(), prefix)
+		})
+	case strings.HasPrefix(spec, "v"):
+		for _, r := range all {
+			if r.GetTagName() == spec {
+				return r, nil
 			}
 		}
-		zap.L().Info("generated package", zap.String("at", dir), zap.Int64("binSize", n))
-		remainingWork = append(remainingWork, fmt.Sprintf("(cd npm/%s; npm publish --access public)", p.Name))
+		return nil, fmt.Errorf("no release tagged %s", spec)
+	default:
+		return nil, fmt.Errorf("unrecognised channel spec %q", spec)
 	}
-	remainingWork = append(remainingWork, "npm publish --access public")
-	fmt.Println(strings.Join(remainingWork, "\n"))
 }
 
-func releaseFromTag(ctx context.Context, client *github.Client, repository *github.Repository, tag *github.RepositoryTag) (*github.RepositoryRelease, error) {
-	// or "Create release" from the ...-button at https://github.com/moby/buildkit/tags
-	zap.L().Fatal("TODO publish manually", zap.String("at", *repository.TagsURL))
-	return nil, nil
-}
\ No newline at end of file
+// newestRelease returns the semver-highest release matching keep.
+func newestRelease(all []*github.RepositoryRelease, keep func(*github.RepositoryRelease) bool) (*github.RepositoryRelease, error) {
+	var best *github.RepositoryRelease
+	for _, r := range all {
+		if !keep(r) || !semver.IsValid(r.GetTagName()) {
+			continue
+		}
+		if best == nil || semver.Compare(r.GetTagName(), best.GetTagName()) > 0 {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no matching release")
+	}
+	return best, nil
+}
+
+// verifyProvenance downloads the release's SLSA provenance attestation
+// (*.intoto.jsonl), verifies it was signed by buildkit's release workflow via
+// Fulcio/cosign keyless signing, and returns the sha256 digest the
+// attestation records for each asset name. It fails closed: a release with no
+// attestation, or one with no detached cosign signature to check it against,
+// is rejected rather than trusted, since either is exactly what an attacker
+// tampering with release assets would produce. Set
+// BUILDCTL_ALLOW_UNSIGNED_PROVENANCE=1 to downgrade that rejection to a
+// warning for releases predating provenance, or cut entirely from this repo.
+func verifyProvenance(ctx context.Context, client *github.Client, release *github.RepositoryRelease) (map[string]string, error) {
+	digests := make(map[string]string)
+	allowUnsigned := os.Getenv("BUILDCTL_ALLOW_UNSIGNED_PROVENANCE") == "1"
+
+	var provenance, signature, cert *github.ReleaseAsset
+	for _, asset := range release.Assets {
+		switch {
+		case provenanceName.MatchString(asset.GetName()):
+			provenance = asset
+		case strings.HasSuffix(asset.GetName(), ".intoto.jsonl.sig"):
+			signature = asset
+		case strings.HasSuffix(asset.GetName(), ".intoto.jsonl.pem"):
+			cert = asset
+		}
+	}
+	if provenance == nil {
+		if !allowUnsigned {
+			return nil, fmt.Errorf("release has no SLSA provenance attestation (set BUILDCTL_ALLOW_UNSIGNED_PROVENANCE=1 to package it anyway)")
+		}
+		zap.L().Warn("release has no SLSA provenance attestation, packaging unverified", zap.String("tag", release.GetTagName()))
+		return digests, nil
+	}
+
+	body, err := fetchAsset(provenance.GetBrowserDownloadURL())
+	if err != nil {
+		return nil, fmt.Errorf("download provenance: %w", err)
+	}
+
+	if signature != nil && cert != nil {
+		sig, err := fetchAsset(signature.GetBrowserDownloadURL())
+		if err != nil {
+			return nil, fmt.Errorf("download provenance signature: %w", err)
+		}
+		pem, err := fetchAsset(cert.GetBrowserDownloadURL())
+		if err != nil {
+			return nil, fmt.Errorf("download provenance certificate: %w", err)
+		}
+		identityRegexp := fmt.Sprintf(`^https://github\.com/%s/%s/\.github/workflows/.+@refs/tags/v\d+\.\d+\.\d+$`, owner, repo)
+		if err := cosign.VerifyBlobCmd(ctx, cosign.CheckOpts{
+			RootCerts:          fulcioroots.Get(),
+			CertOidcIssuer:     fulcioIssuer,
+			CertIdentityRegexp: identityRegexp,
+		}, string(pem), string(sig), body); err != nil {
+			return nil, fmt.Errorf("verify provenance signature: %w", err)
+		}
+	} else if !allowUnsigned {
+		return nil, fmt.Errorf("provenance attestation has no detached cosign signature (set BUILDCTL_ALLOW_UNSIGNED_PROVENANCE=1 to trust it anyway)")
+	} else {
+		zap.L().Warn("provenance attestation has no detached cosign signature, trusting content as-is", zap.String("tag", release.GetTagName()))
+	}
+
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("unmarshal dsse envelope: %w", err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode dsse payload: %w", err)
+	}
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, fmt.Errorf("unmarshal in-toto statement: %w", err)
+	}
+	for _, subject := range statement.Subject {
+		if sha, ok := subject.Digest["sha256"]; ok {
+			digests[subject.Name] = sha
+		}
+	}
+	return digests, nil
+}
+
+func fetchAsset(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// integrity returns a subresource-integrity style sha512 digest of the file
+// at path, e.g. "sha512-...".
+func integrity(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha512-%s", base64.StdEncoding.EncodeToString(h.Sum(nil))), nil
+}
+
+// AssetIntegrity is what postinstall.js needs to fetch and verify an asset
+// directly, for when npm skipped the matching optionalDependency.
+type AssetIntegrity struct {
+	Sha256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+// UmbrellaPackage is the parent npm package users actually `npm install`. It
+// lists every platform package as an optionalDependency (so npm's os/cpu
+// fields skip the wrong ones) and falls back to downloading the matching
+// asset directly via postinstall.js if none was installed.
+type UmbrellaPackage struct {
+	Name                 string                    `json:"name"`
+	Version              string                    `json:"version"`
+	Description          string                    `json:"description,omitempty"`
+	Homepage             string                    `json:"homepage,omitempty"`
+	Licence              string                    `json:"license,omitempty"`
+	Bin                  map[string]string         `json:"bin"`
+	OptionalDependencies map[string]string         `json:"optionalDependencies"`
+	Scripts              map[string]string         `json:"scripts"`
+	Integrity            map[string]AssetIntegrity `json:"integrity"`
+}
+
+// writeUmbrellaPackage writes npm/buildctl/{package.json,bin/buildctl.js,postinstall.js}
+// from the platform packages recorded in manifest, using the stable (non-"next")
+// version when more than one channel was resolved this run.
+func writeUmbrellaPackage(npm string, parent ParentPackage, manifest []ManifestEntry) error {
+	if len(manifest) == 0 {
+		return fmt.Errorf("no packaged platforms to build an umbrella package from")
+	}
+
+	version := manifest[0].Version
+	for _, m := range manifest {
+		if m.NpmTag == "latest" {
+			version = m.Version
+			break
+		}
+	}
+
+	optional := make(map[string]string)
+	assetIntegrity := make(map[string]AssetIntegrity)
+	for _, m := range manifest {
+		if m.Version != version {
+			continue
+		}
+		optional[m.NpmPackage] = m.Version
+		assetIntegrity[m.NpmPackage] = AssetIntegrity{Sha256: m.Sha256, URL: m.AssetURL}
+	}
+
+	p := UmbrellaPackage{
+		Name:                 parent.Name,
+		Version:              version,
+		Homepage:             parent.Homepage,
+		Licence:              parent.Licence,
+		Bin:                  map[string]string{"buildctl": "bin/buildctl.js"},
+		OptionalDependencies: optional,
+		Scripts:              map[string]string{"postinstall": "node postinstall.js"},
+		Integrity:            assetIntegrity,
+	}
+
+	dir := path.Join(npm, "buildctl")
+	bindir := path.Join(dir, "bin")
+	if err := os.MkdirAll(bindir, 0755); err != nil {
+		return fmt.Errorf("umbrella package dir: %w", err)
+	}
+	j, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal umbrella package.json: %w", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "package.json"), j, 0644); err != nil {
+		return fmt.Errorf("write umbrella package.json: %w", err)
+	}
+	if err := ioutil.WriteFile(path.Join(bindir, "buildctl.js"), []byte(buildctlShimJS), 0644); err != nil {
+		return fmt.Errorf("write buildctl.js: %w", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "postinstall.js"), []byte(postinstallJS), 0644); err != nil {
+		return fmt.Errorf("write postinstall.js: %w", err)
+	}
+	return nil
+}
+
+// buildctlShimJS resolves and execs the optionalDependency matching the
+// current platform, the way esbuild/swc's umbrella packages do.
+const buildctlShimJS = `#!/usr/bin/env node
+"use strict";
+
+var path = require("path");
+var fs = require("fs");
+var spawnSync = require("child_process").spawnSync;
+
+var pkg = "buildctl-" + process.platform + "-" + process.arch;
+var binName = process.platform === "win32" ? "buildctl.exe" : "buildctl";
+var bin;
+try {
+  bin = require.resolve(pkg + "/bin/" + binName);
+} catch (err) {
+  // no optionalDependency installed for this platform; postinstall.js may
+  // have downloaded the matching release asset straight into our own bin/
+  var fallback = path.join(__dirname, binName);
+  if (!fs.existsSync(fallback)) {
+    console.error("buildctl: no optionalDependency installed for " + pkg);
+    process.exit(1);
+  }
+  bin = fallback;
+}
+
+var result = spawnSync(bin, process.argv.slice(2), { stdio: "inherit" });
+process.exit(result.status === null ? 1 : result.status);
+`
+
+// postinstallJS chmods the resolved optionalDependency's binary (npm strips
+// the executable bit on some install paths), or, if no optionalDependency
+// was installed, downloads and verifies the matching release asset directly
+// using the sha256 recorded in this package's "integrity" map.
+const postinstallJS = `"use strict";
+
+var fs = require("fs");
+var os = require("os");
+var path = require("path");
+var https = require("https");
+var crypto = require("crypto");
+var child_process = require("child_process");
+
+var pkgJson = require("./package.json");
+var target = "buildctl-" + process.platform + "-" + process.arch;
+var binName = process.platform === "win32" ? "buildctl.exe" : "buildctl";
+
+function chmodExecutable(p) {
+  try {
+    fs.chmodSync(p, 0o755);
+  } catch (err) {
+    // best-effort: npm already preserves the mode on most install paths
+  }
+}
+
+try {
+  chmodExecutable(require.resolve(target + "/bin/" + binName));
+  process.exit(0);
+} catch (err) {
+  // no matching optionalDependency installed, fall through to direct download
+}
+
+var asset = pkgJson.integrity && pkgJson.integrity[target];
+if (!asset || !asset.url || !asset.sha256) {
+  console.error("buildctl: no optionalDependency installed for " + target + ", and no fallback download recorded for it");
+  process.exit(1);
+}
+
+function download(url, onResponse) {
+  https
+    .get(url, function (res) {
+      if (res.statusCode >= 300 && res.statusCode < 400 && res.headers.location) {
+        return download(res.headers.location, onResponse);
+      }
+      if (res.statusCode !== 200) {
+        console.error("buildctl: download failed with status " + res.statusCode);
+        process.exit(1);
+      }
+      onResponse(res);
+    })
+    .on("error", function (err) {
+      console.error("buildctl: download failed: " + err.message);
+      process.exit(1);
+    });
+}
+
+var isZip = /\.zip$/i.test(asset.url);
+var archivePath = path.join(os.tmpdir(), "buildctl-" + process.pid + (isZip ? ".zip" : ".tar.gz"));
+var archiveFile = fs.createWriteStream(archivePath);
+var hash = crypto.createHash("sha256");
+
+download(asset.url, function (res) {
+  res.on("data", function (chunk) {
+    hash.update(chunk);
+  });
+  res.pipe(archiveFile);
+  archiveFile.on("finish", function () {
+    var actual = hash.digest("hex");
+    if (actual !== asset.sha256) {
+      console.error("buildctl: downloaded archive sha256 " + actual + " does not match expected " + asset.sha256);
+      process.exit(1);
+    }
+    var destDir = path.join(__dirname, "bin");
+    fs.mkdirSync(destDir, { recursive: true });
+    if (isZip) {
+      child_process.execFileSync("unzip", ["-o", archivePath, "-d", destDir]);
+    } else {
+      child_process.execFileSync("tar", ["-xzf", archivePath, "-C", destDir, "--strip-components=1"]);
+    }
+    chmodExecutable(path.join(destDir, binName));
+    fs.unlinkSync(archivePath);
+  });
+});
+`
\ No newline at end of file
@@ -2,38 +2,55 @@ package main
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"strings"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+
+	"github.com/turbokube/buildctl-dockerfile/internal/binverify"
 )
 
 type PackageInfo struct {
-	Name        string            `json:"name"`
-	Version     string            `json:"version"`
-	Description string            `json:"description"`
-	Bin         map[string]string `json:"bin"`
-	Os          []string          `json:"os"`
-	Cpu         []string          `json:"cpu"`
+	Name          string            `json:"name"`
+	Version       string            `json:"version"`
+	Description   string            `json:"description"`
+	Bin           map[string]string `json:"bin"`
+	Os            []string          `json:"os"`
+	Cpu           []string          `json:"cpu"`
+	Integrity     string            `json:"integrity,omitempty"`
+	ArchiveSha256 string            `json:"archiveSha256,omitempty"`
+}
+
+// manifestEntry is the subset of publish.go's ManifestEntry this tool reads
+// back out of manifest.json to cross-check package.json's ArchiveSha256
+// against the digest that was actually verified against release provenance.
+type manifestEntry struct {
+	NpmPackage string `json:"npm_package"`
+	Sha256     string `json:"sha256"`
 }
 
 type TestReport struct {
-	Package     string `json:"package"`
-	Version     string `json:"version"`
-	BinaryPath  string `json:"binary_path"`
-	BinarySize  int64  `json:"binary_size"`
-	Checksum    string `json:"checksum"`
-	Executable  bool   `json:"executable"`
-	VersionInfo string `json:"version_info,omitempty"`
-	Error       string `json:"error,omitempty"`
+	Package      string `json:"package"`
+	Version      string `json:"version"`
+	BinaryPath   string `json:"binary_path"`
+	BinarySize   int64  `json:"binary_size"`
+	Checksum     string `json:"checksum"`
+	Executable   bool   `json:"executable"`
+	VersionInfo  string `json:"version_info,omitempty"`
+	IntegrityOk  bool   `json:"integrity_ok"`
+	ProvenanceOk bool   `json:"provenance_ok"`
+	DetectedOS   string `json:"detected_os,omitempty"`
+	DetectedArch string `json:"detected_arch,omitempty"`
+	RunVia       string `json:"run_via,omitempty"`
+	Error        string `json:"error,omitempty"`
 }
 
 func main() {
@@ -57,6 +74,8 @@ func main() {
 		zap.L().Fatal("npm directory does not exist", zap.String("path", npm))
 	}
 
+	manifestSha256 := readManifestSha256(npm)
+
 	var reports []TestReport
 
 	// Read all package directories
@@ -71,7 +90,11 @@ func main() {
 		}
 
 		pkgDir := path.Join(npm, dir.Name())
-		report := testPackage(pkgDir)
+		if isUmbrellaPackage(pkgDir) {
+			zap.L().Info("skipping umbrella package, nothing platform-specific to smoke test", zap.String("dir", pkgDir))
+			continue
+		}
+		report := testPackage(pkgDir, manifestSha256)
 		reports = append(reports, report)
 	}
 
@@ -102,7 +125,52 @@ func main() {
 	}
 }
 
-func testPackage(pkgDir string) TestReport {
+// isUmbrellaPackage reports whether pkgDir holds the umbrella buildctl
+// package that writeUmbrellaPackage generates, rather than a platform
+// package: it lists platform packages as optionalDependencies instead of
+// shipping a binary of its own, so there's nothing here for testPackage to
+// smoke test.
+func isUmbrellaPackage(pkgDir string) bool {
+	packageData, err := ioutil.ReadFile(path.Join(pkgDir, "package.json"))
+	if err != nil {
+		return false
+	}
+	var probe struct {
+		OptionalDependencies map[string]string `json:"optionalDependencies"`
+	}
+	if err := json.Unmarshal(packageData, &probe); err != nil {
+		return false
+	}
+	return len(probe.OptionalDependencies) > 0
+}
+
+// readManifestSha256 reads npm/manifest.json and returns each npm package's
+// recorded archive sha256, keyed by package name, so testPackage can confirm
+// package.json's ArchiveSha256 still matches the digest publish.go actually
+// verified against release provenance. A missing or unparseable manifest
+// just yields an empty map, so provenance cross-checking is skipped rather
+// than failing the whole run.
+func readManifestSha256(npm string) map[string]string {
+	sha256ByPackage := make(map[string]string)
+	manifestData, err := ioutil.ReadFile(path.Join(npm, "manifest.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			zap.L().Warn("read manifest.json, skipping provenance cross-check", zap.Error(err))
+		}
+		return sha256ByPackage
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(manifestData, &entries); err != nil {
+		zap.L().Warn("parse manifest.json, skipping provenance cross-check", zap.Error(err))
+		return sha256ByPackage
+	}
+	for _, e := range entries {
+		sha256ByPackage[e.NpmPackage] = e.Sha256
+	}
+	return sha256ByPackage
+}
+
+func testPackage(pkgDir string, manifestSha256 map[string]string) TestReport {
 	report := TestReport{
 		Package: filepath.Base(pkgDir),
 	}
@@ -161,19 +229,49 @@ func testPackage(pkgDir string) TestReport {
 	defer file.Close()
 
 	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
+	integrityHasher := sha512.New()
+	if _, err := io.Copy(io.MultiWriter(hasher, integrityHasher), file); err != nil {
 		report.Error = fmt.Sprintf("calculate checksum: %v", err)
 		return report
 	}
 
 	report.Checksum = fmt.Sprintf("sha256:%x", hasher.Sum(nil))
 
-	// Try to get version info from binary
-	if report.Executable {
-		cmd := exec.Command(binPath, "--version")
-		output, err := cmd.Output()
-		if err == nil {
-			report.VersionInfo = strings.TrimSpace(string(output))
+	if pkg.Integrity != "" {
+		expected := fmt.Sprintf("sha512-%s", base64.StdEncoding.EncodeToString(integrityHasher.Sum(nil)))
+		report.IntegrityOk = expected == pkg.Integrity
+		if !report.IntegrityOk {
+			report.Error = fmt.Sprintf("integrity mismatch: package.json says %q, extracted binary is %q", pkg.Integrity, expected)
+			return report
+		}
+	}
+
+	// Confirm package.json still names the same archive digest manifest.json
+	// recorded as having been verified against release provenance, so the two
+	// can't have silently drifted apart since publish.go ran.
+	if pkg.ArchiveSha256 != "" {
+		if fromManifest, known := manifestSha256[pkg.Name]; known {
+			report.ProvenanceOk = fromManifest == pkg.ArchiveSha256
+			if !report.ProvenanceOk {
+				report.Error = fmt.Sprintf("provenance digest mismatch: package.json says %q, manifest.json says %q", pkg.ArchiveSha256, fromManifest)
+				return report
+			}
+		} else {
+			zap.L().Warn("no manifest.json entry for package, skipping provenance cross-check", zap.String("package", pkg.Name))
+		}
+	}
+
+	// Confirm the binary's own header matches what package.json declares,
+	// and run it (natively or via qemu-user) to capture --version.
+	if report.Executable && len(pkg.Os) > 0 && len(pkg.Cpu) > 0 {
+		result, err := binverify.Verify(binPath, pkg.Os[0], pkg.Cpu[0])
+		report.DetectedOS = result.DetectedOS
+		report.DetectedArch = result.DetectedArch
+		report.RunVia = result.RunVia
+		report.VersionInfo = result.VersionInfo
+		if err != nil {
+			report.Error = err.Error()
+			return report
 		}
 	}
 